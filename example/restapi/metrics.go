@@ -0,0 +1,15 @@
+package restapi
+
+import (
+	"net/http"
+
+	"github.com/pyama86/pftp/pftp/metrics"
+)
+
+// MetricsHandler exposes pftp's Prometheus metrics. Register it on the
+// example REST server's mux as:
+//
+//	mux.Handle("/metrics", restapi.MetricsHandler())
+func MetricsHandler() http.Handler {
+	return metrics.Handler()
+}
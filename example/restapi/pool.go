@@ -0,0 +1,22 @@
+package restapi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/pyama86/pftp/pftp"
+)
+
+// PoolHandler serves the current health/weight/connection-count snapshot of
+// an OriginPool as JSON, so operators can watch failover state without
+// grepping logs. Register it on the example REST server's mux as:
+//
+//	mux.Handle("/pool", restapi.PoolHandler(pool))
+func PoolHandler(pool *pftp.OriginPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(pool.State()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
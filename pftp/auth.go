@@ -0,0 +1,223 @@
+package pftp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	htpasswd "github.com/tg123/go-htpasswd"
+)
+
+// Auth authenticates an incoming FTP login and resolves the origin address
+// the session should be proxied to once the credential is accepted.
+type Auth interface {
+	Validate(user string, pass string, remoteAddr string) (originAddr string, err error)
+}
+
+// NewAuth builds an Auth implementation from a URL-style DSN configured as
+// auth_backend in config.toml. The scheme selects the provider:
+//
+//	static://originAddr?user=foo&pass=bar  - single credential from config
+//	basicfile:///path/to/htpasswd          - Apache htpasswd file, hot-reloaded
+//	rest://host:port                       - current webapi callback behavior
+//	none://originAddr                      - accept any credential
+func NewAuth(dsn string, log *logger) (Auth, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth_backend %q: %s", dsn, err)
+	}
+
+	switch u.Scheme {
+	case "static":
+		return newStaticAuth(u)
+	case "basicfile":
+		return newBasicFileAuth(u.Path, log)
+	case "rest":
+		return newRestAuth(u)
+	case "none":
+		return &noneAuth{originAddr: u.Host}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth_backend scheme: %s", u.Scheme)
+	}
+}
+
+// staticAuth validates a single credential pair configured directly in
+// config.toml. It is intended for small/dev deployments that do not need a
+// full user directory.
+type staticAuth struct {
+	user       string
+	pass       string
+	originAddr string
+}
+
+func newStaticAuth(u *url.URL) (*staticAuth, error) {
+	q := u.Query()
+	user := q.Get("user")
+	pass := q.Get("pass")
+	if user == "" {
+		return nil, fmt.Errorf("static auth_backend requires a user parameter")
+	}
+
+	return &staticAuth{
+		user:       user,
+		pass:       pass,
+		originAddr: u.Host,
+	}, nil
+}
+
+func (a *staticAuth) Validate(user string, pass string, remoteAddr string) (string, error) {
+	if user != a.user || pass != a.pass {
+		return "", fmt.Errorf("invalid username or password")
+	}
+	return a.originAddr, nil
+}
+
+// noneAuth accepts any credential and always routes to the configured
+// originAddr. Useful for local testing or when authentication is handled
+// upstream of pftp.
+type noneAuth struct {
+	originAddr string
+}
+
+func (a *noneAuth) Validate(user string, pass string, remoteAddr string) (string, error) {
+	return a.originAddr, nil
+}
+
+// restAuth preserves the existing behavior of delegating origin resolution
+// to a REST webapi, keyed on the FTP username.
+type restAuth struct {
+	baseURL string
+}
+
+func newRestAuth(u *url.URL) (*restAuth, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("rest auth_backend requires a host, e.g. rest://127.0.0.1:8080")
+	}
+	return &restAuth{baseURL: fmt.Sprintf("http://%s", u.Host)}, nil
+}
+
+func (a *restAuth) Validate(user string, pass string, remoteAddr string) (string, error) {
+	resp, err := http.Get(fmt.Sprintf("%s/user/%s", a.baseURL, user))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("webapi returned status %d for user %s", resp.StatusCode, user)
+	}
+
+	var body struct {
+		OriginAddr string `json:"origin_addr"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	return body.OriginAddr, nil
+}
+
+// basicFileAuth validates credentials against an Apache htpasswd file
+// (bcrypt/SHA/crypt hashes) and watches it with fsnotify so operators can
+// add/remove/rotate users without restarting pftp or dropping active
+// sessions.
+type basicFileAuth struct {
+	path    string
+	log     *logger
+	mutex   sync.RWMutex
+	file    *htpasswd.File
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+func newBasicFileAuth(path string, log *logger) (*basicFileAuth, error) {
+	f, err := htpasswd.New(path, htpasswd.DefaultSystems, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load htpasswd file %q: %s", path, err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch htpasswd file %q: %s", path, err)
+	}
+	// Watch the containing directory rather than path itself: fsnotify binds
+	// to the inode, so an operator replacing the file via "write new file,
+	// then rename over the target" (the common atomic-update pattern) would
+	// swap the watched inode out from under us and silently stop delivering
+	// events after the first external update.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch htpasswd file %q: %s", path, err)
+	}
+
+	a := &basicFileAuth{
+		path:    path,
+		log:     log,
+		file:    f,
+		watcher: watcher,
+		done:    make(chan struct{}),
+	}
+	go a.watch()
+
+	return a, nil
+}
+
+// Close stops the watcher goroutine and releases its inotify watch. It
+// blocks until watch() has actually exited, so a caller rebuilding the auth
+// backend (e.g. on a config reload) doesn't leak the watch or the goroutine.
+func (a *basicFileAuth) Close() {
+	a.watcher.Close()
+	<-a.done
+}
+
+func (a *basicFileAuth) watch() {
+	defer close(a.done)
+	for {
+		select {
+		case event, ok := <-a.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != filepath.Base(a.path) {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+
+			f, err := htpasswd.New(a.path, htpasswd.DefaultSystems, nil)
+			if err != nil {
+				a.log.info("failed to reload htpasswd file %s: %s", a.path, err)
+				continue
+			}
+
+			a.mutex.Lock()
+			a.file = f
+			a.mutex.Unlock()
+			a.log.info("reloaded htpasswd file %s", a.path)
+		case err, ok := <-a.watcher.Errors:
+			if !ok {
+				return
+			}
+			a.log.info("htpasswd watcher error: %s", err)
+		}
+	}
+}
+
+// Validate does not resolve an origin address by itself; basicfile is meant
+// to be combined with the User middleware's own routing, so it always
+// returns an empty originAddr on success and leaves routing to the caller.
+func (a *basicFileAuth) Validate(user string, pass string, remoteAddr string) (string, error) {
+	a.mutex.RLock()
+	f := a.file
+	a.mutex.RUnlock()
+
+	if !f.Match(user, pass) {
+		return "", fmt.Errorf("invalid username or password")
+	}
+	return "", nil
+}
@@ -0,0 +1,195 @@
+package pftp
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewAuthDispatchesByScheme(t *testing.T) {
+	htpasswdPath := writeTempHtpasswd(t, "alice:$apr1$A9Q1KcqJ$eZ6m4IELFe.hQdnM/0jTi1\n")
+
+	tests := []struct {
+		name    string
+		dsn     string
+		want    Auth
+		wantErr bool
+	}{
+		{name: "static", dsn: "static://origin:21?user=alice&pass=secret"},
+		{name: "basicfile", dsn: "basicfile://" + htpasswdPath},
+		{name: "rest", dsn: "rest://127.0.0.1:8080"},
+		{name: "none", dsn: "none://origin:21"},
+		{name: "unknown scheme", dsn: "bogus://origin:21", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewAuth(tt.dsn, &logger{})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NewAuth(%q) returned nil error, want one", tt.dsn)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewAuth(%q) returned error: %v", tt.dsn, err)
+			}
+			if a == nil {
+				t.Fatalf("NewAuth(%q) returned nil Auth with no error", tt.dsn)
+			}
+		})
+	}
+}
+
+func TestNewAuthRejectsInvalidDSN(t *testing.T) {
+	if _, err := NewAuth("://", &logger{}); err == nil {
+		t.Fatal("NewAuth with an unparseable DSN returned nil error")
+	}
+}
+
+func TestNewStaticAuthRequiresUser(t *testing.T) {
+	u, _ := url.Parse("static://origin:21?pass=secret")
+	if _, err := newStaticAuth(u); err == nil {
+		t.Fatal("newStaticAuth without a user parameter returned nil error")
+	}
+}
+
+func TestNewStaticAuthParsesOriginAndCredentials(t *testing.T) {
+	u, _ := url.Parse("static://origin:21?user=alice&pass=secret")
+	a, err := newStaticAuth(u)
+	if err != nil {
+		t.Fatalf("newStaticAuth returned error: %v", err)
+	}
+	if a.user != "alice" || a.pass != "secret" || a.originAddr != "origin:21" {
+		t.Fatalf("newStaticAuth parsed %+v, want user=alice pass=secret originAddr=origin:21", a)
+	}
+
+	if _, err := a.Validate("alice", "secret", "127.0.0.1"); err != nil {
+		t.Fatalf("Validate with correct credentials returned error: %v", err)
+	}
+	if _, err := a.Validate("alice", "wrong", "127.0.0.1"); err == nil {
+		t.Fatal("Validate with wrong password returned nil error")
+	}
+}
+
+func TestNewRestAuthRequiresHost(t *testing.T) {
+	u, _ := url.Parse("rest://")
+	if _, err := newRestAuth(u); err == nil {
+		t.Fatal("newRestAuth without a host returned nil error")
+	}
+}
+
+func TestNewRestAuthBuildsBaseURL(t *testing.T) {
+	u, _ := url.Parse("rest://127.0.0.1:8080")
+	a, err := newRestAuth(u)
+	if err != nil {
+		t.Fatalf("newRestAuth returned error: %v", err)
+	}
+	if a.baseURL != "http://127.0.0.1:8080" {
+		t.Fatalf("newRestAuth baseURL = %q, want %q", a.baseURL, "http://127.0.0.1:8080")
+	}
+}
+
+func TestBasicFileAuthValidate(t *testing.T) {
+	htpasswdPath := writeTempHtpasswd(t, "alice:$apr1$A9Q1KcqJ$eZ6m4IELFe.hQdnM/0jTi1\n")
+
+	a, err := newBasicFileAuth(htpasswdPath, &logger{})
+	if err != nil {
+		t.Fatalf("newBasicFileAuth returned error: %v", err)
+	}
+
+	if _, err := a.Validate("alice", "password", "127.0.0.1"); err != nil {
+		t.Fatalf("Validate with correct credentials returned error: %v", err)
+	}
+	if _, err := a.Validate("alice", "wrong", "127.0.0.1"); err == nil {
+		t.Fatal("Validate with wrong password returned nil error")
+	}
+	if _, err := a.Validate("bob", "password", "127.0.0.1"); err == nil {
+		t.Fatal("Validate with unknown user returned nil error")
+	}
+}
+
+// TestBasicFileAuthReloadsAfterAtomicRename exercises the common "write the
+// replacement to a temp file, then rename it over the target" update
+// pattern, which swaps out the inode fsnotify would bind to if the watcher
+// followed the file itself rather than its containing directory.
+func TestBasicFileAuthReloadsAfterAtomicRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "htpasswd")
+	if err := os.WriteFile(path, []byte("alice:$apr1$A9Q1KcqJ$eZ6m4IELFe.hQdnM/0jTi1\n"), 0o644); err != nil {
+		t.Fatalf("writing initial htpasswd file: %v", err)
+	}
+
+	a, err := newBasicFileAuth(path, &logger{})
+	if err != nil {
+		t.Fatalf("newBasicFileAuth returned error: %v", err)
+	}
+
+	if _, err := a.Validate("bob", "password", "127.0.0.1"); err == nil {
+		t.Fatal("Validate for bob succeeded before the htpasswd file was updated")
+	}
+
+	replacement := filepath.Join(dir, "htpasswd.tmp")
+	if err := os.WriteFile(replacement, []byte("bob:$apr1$A9Q1KcqJ$eZ6m4IELFe.hQdnM/0jTi1\n"), 0o644); err != nil {
+		t.Fatalf("writing replacement htpasswd file: %v", err)
+	}
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatalf("renaming replacement over htpasswd file: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := a.Validate("bob", "password", "127.0.0.1"); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("basicFileAuth did not reload after the htpasswd file was renamed over")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestBasicFileAuthCloseStopsWatcher confirms Close tears down the fsnotify
+// watcher and waits for the watch() goroutine to exit, rather than leaking
+// both for the life of the process every time the auth backend is rebuilt.
+func TestBasicFileAuthCloseStopsWatcher(t *testing.T) {
+	htpasswdPath := writeTempHtpasswd(t, "alice:$apr1$A9Q1KcqJ$eZ6m4IELFe.hQdnM/0jTi1\n")
+
+	a, err := newBasicFileAuth(htpasswdPath, &logger{})
+	if err != nil {
+		t.Fatalf("newBasicFileAuth returned error: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close did not return after the watcher was closed")
+	}
+
+	select {
+	case <-a.done:
+	default:
+		t.Fatal("Close returned before watch() exited")
+	}
+}
+
+// writeTempHtpasswd writes an htpasswd file (the apr1 hash the tests pass in
+// is for the password "password") to a fresh temp directory and returns its
+// path.
+func writeTempHtpasswd(t *testing.T, contents string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "htpasswd")
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("writing temp htpasswd file: %v", err)
+	}
+	return path
+}
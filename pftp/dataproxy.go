@@ -0,0 +1,27 @@
+package pftp
+
+import (
+	"io"
+	"net"
+)
+
+// dataProxy is the fast path used for a session's data connection once
+// PASV/EPSV/PORT negotiation has completed and the session is in
+// passThrough mode. It replaces the mutex-guarded per-4KB write loop start
+// uses for the control channel with a direct kernel splice between the two
+// TCP sockets, which matters for the multi-hundred-megabyte transfers this
+// proxy is expected to carry.
+//
+// It falls back to an ordinary io.Copy whenever either end is not a raw
+// *net.TCPConn or MODE Z is active, since both TLS and MODE Z need to touch
+// the plaintext stream rather than let the kernel move it directly.
+func (s *proxyServer) dataProxy(dst net.Conn, src net.Conn) (int64, error) {
+	dstConn, dstOK := dst.(*net.TCPConn)
+	srcConn, srcOK := src.(*net.TCPConn)
+
+	if !s.modeZ && dstOK && srcOK {
+		return spliceCopy(dstConn, srcConn)
+	}
+
+	return io.Copy(dst, src)
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package pftp
+
+import "net"
+
+// spliceCopy moves bytes from src to dst using *net.TCPConn.ReadFrom, which
+// the Go runtime implements via syscall.Splice on Linux, so the kernel pipes
+// data directly between the two sockets without ever landing in a userland
+// buffer.
+func spliceCopy(dst, src *net.TCPConn) (int64, error) {
+	return dst.ReadFrom(src)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package pftp
+
+import (
+	"io"
+	"net"
+)
+
+// spliceCopy falls back to an ordinary io.Copy on platforms where
+// syscall.Splice is unavailable.
+func spliceCopy(dst, src *net.TCPConn) (int64, error) {
+	return io.Copy(dst, src)
+}
@@ -0,0 +1,219 @@
+package pftp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+)
+
+// loopbackPair dials a TCP loopback connection and hands back both ends as
+// *net.TCPConn, the same type the data channel uses once PASV/PORT
+// negotiation completes.
+func loopbackPair(tb testing.TB) (server, client *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			tb.Error(err)
+			return
+		}
+		accepted <- c
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return (<-accepted).(*net.TCPConn), c.(*net.TCPConn)
+}
+
+// byteReader replays a fixed payload once, so each iteration transfers an
+// identical amount of data.
+type byteReader struct {
+	data []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDataProxySplicesTCPToTCP(t *testing.T) {
+	feederServer, feederClient := loopbackPair(t)
+	defer feederServer.Close()
+	defer feederClient.Close()
+
+	sinkServer, sinkClient := loopbackPair(t)
+	defer sinkServer.Close()
+	defer sinkClient.Close()
+
+	payload := []byte("the quick brown fox jumps over the lazy dog")
+	go func() {
+		io.Copy(feederServer, bytes.NewReader(payload))
+		feederServer.Close()
+	}()
+
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(sinkClient)
+		received <- b
+	}()
+
+	s := &proxyServer{modeZ: false}
+	n, err := s.dataProxy(sinkServer, feederClient)
+	if err != nil {
+		t.Fatalf("dataProxy returned error: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Fatalf("dataProxy copied %d bytes, want %d", n, len(payload))
+	}
+	sinkServer.Close()
+
+	if got := <-received; !bytes.Equal(got, payload) {
+		t.Fatalf("sink received %q, want %q", got, payload)
+	}
+}
+
+// TestDataProxyFallsBackWhenModeZActive verifies that an active MODE Z
+// session still transfers correctly through the io.Copy fallback, even
+// though both ends are *net.TCPConn and would otherwise be splice-eligible.
+func TestDataProxyFallsBackWhenModeZActive(t *testing.T) {
+	feederServer, feederClient := loopbackPair(t)
+	defer feederServer.Close()
+	defer feederClient.Close()
+
+	sinkServer, sinkClient := loopbackPair(t)
+	defer sinkServer.Close()
+	defer sinkClient.Close()
+
+	payload := []byte("compressed-looking payload")
+	go func() {
+		io.Copy(feederServer, bytes.NewReader(payload))
+		feederServer.Close()
+	}()
+
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(sinkClient)
+		received <- b
+	}()
+
+	s := &proxyServer{modeZ: true}
+	n, err := s.dataProxy(sinkServer, feederClient)
+	if err != nil {
+		t.Fatalf("dataProxy returned error: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Fatalf("dataProxy copied %d bytes, want %d", n, len(payload))
+	}
+	sinkServer.Close()
+
+	if got := <-received; !bytes.Equal(got, payload) {
+		t.Fatalf("sink received %q, want %q", got, payload)
+	}
+}
+
+// TestDataProxyFallsBackForNonTCPConn verifies the io.Copy fallback for
+// connections that aren't *net.TCPConn, e.g. a TLS-wrapped session.
+func TestDataProxyFallsBackForNonTCPConn(t *testing.T) {
+	dst, dstPeer := net.Pipe()
+	src, srcPeer := net.Pipe()
+	defer dst.Close()
+	defer dstPeer.Close()
+	defer src.Close()
+	defer srcPeer.Close()
+
+	payload := []byte("piped payload")
+	go func() {
+		srcPeer.Write(payload)
+		srcPeer.Close()
+	}()
+
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(dstPeer)
+		received <- b
+	}()
+
+	s := &proxyServer{modeZ: false}
+	n, err := s.dataProxy(dst, src)
+	if err != nil {
+		t.Fatalf("dataProxy returned error: %v", err)
+	}
+	if n != int64(len(payload)) {
+		t.Fatalf("dataProxy copied %d bytes, want %d", n, len(payload))
+	}
+	dst.Close()
+
+	if got := <-received; !bytes.Equal(got, payload) {
+		t.Fatalf("dst peer received %q, want %q", got, payload)
+	}
+}
+
+// runTransferBenchmark wires up a feeder TCP pair (source payload) and a
+// sink TCP pair (drained as it arrives) and times copyFn moving bytes from
+// the feeder to the sink, mirroring how the data channel relays a large
+// STOR/RETR transfer between client and origin.
+func runTransferBenchmark(b *testing.B, copyFn func(dst, src *net.TCPConn) (int64, error)) {
+	const payloadSize = 32 * 1024 * 1024
+
+	payload := make([]byte, payloadSize)
+	if _, err := rand.Read(payload); err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(payloadSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		feederServer, feederClient := loopbackPair(b)
+		sinkServer, sinkClient := loopbackPair(b)
+
+		go func() {
+			io.Copy(feederServer, &byteReader{append([]byte(nil), payload...)})
+			feederServer.Close()
+		}()
+
+		drained := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, sinkClient)
+			close(drained)
+		}()
+
+		if _, err := copyFn(sinkServer, feederClient); err != nil {
+			b.Fatal(err)
+		}
+		sinkServer.Close()
+		<-drained
+
+		feederClient.Close()
+		sinkClient.Close()
+	}
+}
+
+// BenchmarkDataProxySplice measures the kernel-splice fast path used for
+// pass-through data connections.
+func BenchmarkDataProxySplice(b *testing.B) {
+	runTransferBenchmark(b, spliceCopy)
+}
+
+// BenchmarkDataProxyBuffered measures the same transfer through an ordinary
+// io.Copy, for comparison against the splice fast path.
+func BenchmarkDataProxyBuffered(b *testing.B) {
+	runTransferBenchmark(b, func(dst, src *net.TCPConn) (int64, error) {
+		return io.Copy(dst, src)
+	})
+}
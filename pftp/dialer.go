@@ -0,0 +1,43 @@
+package pftp
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// newOriginDialer builds the proxy.Dialer used for every outbound connection
+// to an FTP origin. When upstreamProxy is empty, connections are made
+// directly; otherwise upstreamProxy is parsed as a socks5:// URL (optionally
+// carrying basic auth) and all dials are routed through that SOCKS5 proxy,
+// including the data-channel dials made during PASV/EPSV/PORT translation.
+func newOriginDialer(upstreamProxy string) (proxy.Dialer, error) {
+	if upstreamProxy == "" {
+		return proxy.Direct, nil
+	}
+
+	u, err := url.Parse(upstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream_proxy %q: %s", upstreamProxy, err)
+	}
+
+	var auth *proxy.Auth
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth = &proxy.Auth{
+			User:     u.User.Username(),
+			Password: pass,
+		}
+	}
+
+	return proxy.SOCKS5("tcp", u.Host, auth, proxy.Direct)
+}
+
+// dialOrigin dials originAddr through d, the same dialer used for the
+// session's control connection, so the data channel traverses the same
+// SOCKS5 hop.
+func dialOrigin(d proxy.Dialer, originAddr string) (net.Conn, error) {
+	return d.Dial("tcp", originAddr)
+}
@@ -0,0 +1,89 @@
+// Package metrics exposes the Prometheus counters and histograms pftp
+// records for every session, so an operator can scrape /metrics instead of
+// relying on debug logging alone for capacity planning.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	// ActiveSessions is the number of FTP sessions currently proxied.
+	ActiveSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pftp",
+		Name:      "active_sessions",
+		Help:      "Number of FTP sessions currently proxied.",
+	})
+
+	// BytesTransferred counts payload bytes copied between client and
+	// origin, labeled by user, origin and direction (in/out).
+	BytesTransferred = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pftp",
+		Name:      "bytes_transferred_total",
+		Help:      "Bytes copied between client and origin.",
+	}, []string{"user", "origin", "direction"})
+
+	// CommandsTotal counts FTP commands forwarded to the origin, labeled by
+	// verb (USER, STOR, RETR, ...).
+	CommandsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pftp",
+		Name:      "commands_total",
+		Help:      "FTP commands forwarded to the origin, by verb.",
+	}, []string{"command"})
+
+	// TLSHandshakeFailures counts failed AUTH TLS/SSL negotiations with an
+	// origin server.
+	TLSHandshakeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pftp",
+		Name:      "tls_handshake_failures_total",
+		Help:      "TLS handshakes with an origin server that failed.",
+	})
+
+	// OriginSwitches counts successful origin switches, both manual
+	// (webapi-driven, via switchOrigin) and automatic (pool failover, via
+	// failoverOrigin).
+	OriginSwitches = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "pftp",
+		Name:      "origin_switches_total",
+		Help:      "Number of times a session's origin connection was switched.",
+	})
+
+	// SemaphoreWaitSeconds measures how long sendToOrigin waited for the
+	// response semaphore before it could send a command.
+	SemaphoreWaitSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "pftp",
+		Name:      "semaphore_wait_seconds",
+		Help:      "Time spent waiting for the origin semaphore in sendToOrigin.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	// TransferDurationSeconds measures how long a data-transfer copy loop
+	// ran, labeled by direction (in/out).
+	TransferDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pftp",
+		Name:      "transfer_duration_seconds",
+		Help:      "Duration of a data-transfer copy loop.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"direction"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		ActiveSessions,
+		BytesTransferred,
+		CommandsTotal,
+		TLSHandshakeFailures,
+		OriginSwitches,
+		SemaphoreWaitSeconds,
+		TransferDurationSeconds,
+	)
+}
+
+// Handler returns the http.Handler to mount at /metrics on the example REST
+// server.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
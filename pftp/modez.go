@@ -0,0 +1,239 @@
+package pftp
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// modeZDefaultLevel is used when a client negotiates MODE Z without sending
+// an explicit OPTS MODE Z LEVEL n.
+const modeZDefaultLevel = 6
+
+// handleModeCommand intercepts MODE and OPTS MODE Z LEVEL n commands from
+// the client. Because compression is negotiated purely between pftp and the
+// client, these commands must never reach the origin: it keeps speaking
+// MODE S throughout. handled reports whether the command was fully answered
+// here.
+func (s *proxyServer) handleModeCommand(line string) (handled bool, reply string) {
+	if !s.modeZAllowed {
+		return false, ""
+	}
+
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) == 0 {
+		return false, ""
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case "MODE":
+		if len(fields) < 2 {
+			return false, ""
+		}
+		switch strings.ToUpper(fields[1]) {
+		case "Z":
+			s.modeZ = true
+			s.log.info("client negotiated MODE Z compression (level=%d)", s.modeZLevel)
+			return true, "200 MODE Z ok\r\n"
+		case "S":
+			s.modeZ = false
+			return true, "200 MODE S ok\r\n"
+		}
+	case "OPTS":
+		if len(fields) >= 4 && strings.ToUpper(fields[1]) == "MODE" &&
+			strings.ToUpper(fields[2]) == "Z" && strings.ToUpper(fields[3]) == "LEVEL" {
+			level := modeZDefaultLevel
+			if len(fields) >= 5 {
+				if n, err := strconv.Atoi(fields[4]); err == nil && n >= 1 && n <= 9 {
+					level = n
+				}
+			}
+			s.modeZLevel = level
+			return true, fmt.Sprintf("200 OPTS MODE Z LEVEL %d ok\r\n", level)
+		}
+	}
+
+	return false, ""
+}
+
+// advertiseModeZ inserts a MODE Z feature line into a multi-line FEAT reply
+// (as read by handleFeatResponse, one element per line including its
+// trailing CRLF), just before the closing "211 ..." line, when this
+// session's policy allows compression. lines is returned unmodified if
+// MODE Z isn't allowed or the reply was empty.
+func (s *proxyServer) advertiseModeZ(lines []string) []string {
+	// A single-line reply (e.g. "502 FEAT not implemented.") has no
+	// continuation lines to splice before; readMultilineReply only returns
+	// more than one line when the origin actually sent a multi-line reply.
+	if !s.modeZAllowed || len(lines) < 2 {
+		return lines
+	}
+	out := make([]string, 0, len(lines)+1)
+	out = append(out, lines[:len(lines)-1]...)
+	out = append(out, " MODE Z\r\n")
+	out = append(out, lines[len(lines)-1])
+	return out
+}
+
+// handleFeatResponse reads the origin's full multi-line FEAT reply,
+// advertises MODE Z when this session's policy allows it, and forwards the
+// (possibly extended) reply to the client. It's dispatched from
+// responseProxy instead of the generic buffered copy loop, since FEAT's
+// body has to be parsed and rewritten, not just relayed byte-for-byte.
+func (s *proxyServer) handleFeatResponse() error {
+	lines, err := s.readMultilineReply()
+	if err != nil {
+		return err
+	}
+	lines = s.advertiseModeZ(lines)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, line := range lines {
+		if _, err := s.clientWriter.WriteString(line); err != nil {
+			return err
+		}
+	}
+	return s.clientWriter.Flush()
+}
+
+// readMultilineReply reads a full FTP multi-line reply from the origin
+// (e.g. FEAT's "211-Features" ... "211 End"), returning each line including
+// its trailing CRLF. Per RFC 959, a multi-line reply's first line has its
+// reply code followed by '-', and the final line repeats the same code
+// followed by a space; everything in between is free-form.
+func (s *proxyServer) readMultilineReply() ([]string, error) {
+	first, err := s.originReader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	lines := []string{first}
+
+	trimmed := strings.TrimRight(first, "\r\n")
+	if len(trimmed) < 4 || trimmed[3] != '-' {
+		return lines, nil
+	}
+	code := trimmed[:3]
+
+	for {
+		line, err := s.originReader.ReadString('\n')
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+
+		if strings.HasPrefix(strings.TrimRight(line, "\r\n"), code+" ") {
+			break
+		}
+	}
+	return lines, nil
+}
+
+// wrapDataReader wraps a data-connection reader with a DEFLATE decompressor
+// when MODE Z is active for this session.
+func (s *proxyServer) wrapDataReader(r io.Reader) io.Reader {
+	if !s.modeZ {
+		return r
+	}
+	return flate.NewReader(r)
+}
+
+// writeFlusher is the subset of *bufio.Writer that wrapDataWriter needs:
+// buffered writes plus the ability to push them onto the wire on demand.
+type writeFlusher interface {
+	io.Writer
+	Flush() error
+}
+
+// modeZWriteCloser is what start()'s copy loop writes through regardless of
+// whether MODE Z is active: a per-chunk Flush to push data onto the wire
+// immediately, matching the unwrapped writer's existing behavior, and a
+// Close once the transfer ends to flush any buffered compressed tail.
+type modeZWriteCloser interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// wrapDataWriter wraps a data-connection writer with a DEFLATE compressor
+// when MODE Z is active for this session. The returned modeZWriteCloser
+// must be closed by the caller once the transfer completes to flush the
+// final DEFLATE block; closing also logs the achieved compression ratio.
+func (s *proxyServer) wrapDataWriter(w writeFlusher) modeZWriteCloser {
+	if !s.modeZ {
+		return nopWriteCloser{w}
+	}
+
+	out := &countingWriter{w: w}
+	fw, err := flate.NewWriter(out, s.modeZLevel)
+	if err != nil {
+		// An invalid level was already rejected in handleModeCommand, so
+		// this can only happen for a programmer error; fall back to
+		// passthrough rather than dropping the transfer.
+		return nopWriteCloser{w}
+	}
+	return &modeZWriter{flate: fw, out: out, log: s.log}
+}
+
+type nopWriteCloser struct {
+	writeFlusher
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// countingWriter tracks the number of compressed bytes sent downstream so
+// the achieved ratio can be logged when the transfer finishes.
+type countingWriter struct {
+	w writeFlusher
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// modeZWriter wraps a flate.Writer so Flush pushes a compressed block onto
+// the wire without ending the stream, and Close both finishes the
+// compressed stream and logs how much bandwidth MODE Z saved.
+type modeZWriter struct {
+	flate *flate.Writer
+	out   *countingWriter
+	in    int64
+	log   *logger
+}
+
+func (m *modeZWriter) Write(p []byte) (int, error) {
+	n, err := m.flate.Write(p)
+	m.in += int64(n)
+	return n, err
+}
+
+// Flush pushes pending compressed bytes through to the underlying
+// connection, without ending the DEFLATE stream. start()'s copy loop calls
+// this once per chunk, the same way it already flushes the unwrapped writer,
+// so compressed data doesn't sit buffered indefinitely mid-transfer.
+func (m *modeZWriter) Flush() error {
+	if err := m.flate.Flush(); err != nil {
+		return err
+	}
+	return m.out.w.Flush()
+}
+
+func (m *modeZWriter) Close() error {
+	if err := m.flate.Close(); err != nil {
+		return err
+	}
+	if err := m.out.w.Flush(); err != nil {
+		return err
+	}
+	ratio := 1.0
+	if m.out.n > 0 {
+		ratio = float64(m.in) / float64(m.out.n)
+	}
+	m.log.debug("MODE Z: %d bytes -> %d bytes (ratio %.2fx)", m.in, m.out.n, ratio)
+	return nil
+}
@@ -0,0 +1,201 @@
+package pftp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+// flushBuffer adapts a *bytes.Buffer to the writeFlusher interface
+// wrapDataWriter requires, since bytes.Buffer itself has no Flush method.
+type flushBuffer struct {
+	*bytes.Buffer
+}
+
+func (flushBuffer) Flush() error { return nil }
+
+func TestModeZRoundTrip(t *testing.T) {
+	s := &proxyServer{modeZ: true, modeZLevel: modeZDefaultLevel, log: &logger{}}
+
+	var compressed bytes.Buffer
+	w := s.wrapDataWriter(&flushBuffer{Buffer: &compressed})
+
+	payload := []byte("the quick brown fox jumps over the lazy dog. the quick brown fox jumps over the lazy dog.")
+	if _, err := w.Write(payload); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	if compressed.Len() >= len(payload) {
+		t.Fatalf("compressed output (%d bytes) is not smaller than the input (%d bytes)", compressed.Len(), len(payload))
+	}
+
+	got, err := io.ReadAll(s.wrapDataReader(&compressed))
+	if err != nil {
+		t.Fatalf("reading decompressed data: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("round trip mismatch: got %q, want %q", got, payload)
+	}
+}
+
+func TestModeZDisabledIsPassthrough(t *testing.T) {
+	s := &proxyServer{modeZ: false}
+
+	var buf bytes.Buffer
+	w := s.wrapDataWriter(&flushBuffer{Buffer: &buf})
+	payload := []byte("plain text, no compression")
+	if _, err := w.Write(payload); err != nil {
+		t.Fatalf("Write returned error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Fatalf("passthrough write mismatch: got %q, want %q", buf.Bytes(), payload)
+	}
+
+	got, err := io.ReadAll(s.wrapDataReader(&buf))
+	if err != nil {
+		t.Fatalf("reading passthrough data: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("passthrough read mismatch: got %q, want %q", got, payload)
+	}
+}
+
+func TestAdvertiseModeZInsertsBeforeClosingLine(t *testing.T) {
+	s := &proxyServer{modeZAllowed: true}
+	lines := []string{
+		"211-Features:\r\n",
+		" UTF8\r\n",
+		"211 End\r\n",
+	}
+
+	got := s.advertiseModeZ(lines)
+	want := []string{
+		"211-Features:\r\n",
+		" UTF8\r\n",
+		" MODE Z\r\n",
+		"211 End\r\n",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("advertiseModeZ returned %d lines, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("line %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAdvertiseModeZNoopForSingleLineReply(t *testing.T) {
+	s := &proxyServer{modeZAllowed: true}
+	lines := []string{"502 FEAT not implemented.\r\n"}
+
+	got := s.advertiseModeZ(lines)
+	if len(got) != 1 || got[0] != lines[0] {
+		t.Fatalf("advertiseModeZ modified a single-line reply: %v", got)
+	}
+}
+
+func TestAdvertiseModeZNoopWhenNotAllowed(t *testing.T) {
+	s := &proxyServer{modeZAllowed: false}
+	lines := []string{"211-Features:\r\n", "211 End\r\n"}
+
+	got := s.advertiseModeZ(lines)
+	if len(got) != len(lines) {
+		t.Fatalf("advertiseModeZ modified lines when modeZAllowed is false: %v", got)
+	}
+}
+
+func TestHandleFeatResponseAdvertisesModeZToClient(t *testing.T) {
+	originServer, originClient := net.Pipe()
+	defer originServer.Close()
+	defer originClient.Close()
+
+	clientServer, clientClient := net.Pipe()
+	defer clientServer.Close()
+	defer clientClient.Close()
+
+	s := &proxyServer{
+		modeZAllowed: true,
+		originReader: bufio.NewReader(originClient),
+		clientWriter: bufio.NewWriter(clientServer),
+		mutex:        &sync.Mutex{},
+	}
+
+	go func() {
+		originServer.Write([]byte("211-Features:\r\n UTF8\r\n211 End\r\n"))
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- s.handleFeatResponse() }()
+
+	got, err := io.ReadAll(io.LimitReader(clientClient, int64(len("211-Features:\r\n UTF8\r\n MODE Z\r\n211 End\r\n"))))
+	if err != nil {
+		t.Fatalf("reading FEAT reply from client side: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("handleFeatResponse returned error: %v", err)
+	}
+
+	want := "211-Features:\r\n UTF8\r\n MODE Z\r\n211 End\r\n"
+	if string(got) != want {
+		t.Fatalf("client received %q, want %q", got, want)
+	}
+}
+
+// TestStartLeavesCommandRepliesUncompressedOutsidePassThrough verifies that
+// an ordinary command reply relayed while the session is waiting on a single
+// response (passThrough false, semLocked true) reaches the client as
+// plaintext even though MODE Z is negotiated, since start() also carries the
+// control channel and only the passThrough leg of a session is the actual
+// MODE Z data transfer.
+func TestStartLeavesCommandRepliesUncompressedOutsidePassThrough(t *testing.T) {
+	originServer, originClient := net.Pipe()
+	defer originServer.Close()
+	defer originClient.Close()
+
+	clientServer, clientClient := net.Pipe()
+	defer clientServer.Close()
+	defer clientClient.Close()
+
+	s := &proxyServer{
+		modeZ:        true,
+		passThrough:  false,
+		sem:          1,
+		stopChan:     make(chan struct{}),
+		mutex:        &sync.Mutex{},
+		log:          &logger{},
+		origin:       originClient,
+		originReader: bufio.NewReader(originClient),
+		clientWriter: bufio.NewWriter(clientServer),
+	}
+
+	reply := "250 CWD command successful.\r\n"
+	go func() { originServer.Write([]byte(reply)) }()
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.start(s.originReader, s.clientWriter) }()
+
+	got, err := io.ReadAll(io.LimitReader(clientClient, int64(len(reply))))
+	if err != nil {
+		t.Fatalf("reading control reply from client side: %v", err)
+	}
+	if string(got) != reply {
+		t.Fatalf("client received %q, want plaintext %q", got, reply)
+	}
+
+	s.semLock()
+	originServer.Close()
+	if err := <-errc; err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("start returned unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package pftp
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// originBackendConfig describes one backend in an OriginPool, as configured
+// in config.toml under an [[origin_pool.backends]] array.
+type originBackendConfig struct {
+	Addr   string
+	Weight int
+}
+
+// originBackend tracks the live health state of one configured backend.
+type originBackend struct {
+	addr    string
+	weight  int
+	healthy bool
+	conns   int
+}
+
+// OriginPoolStrategy selects how a healthy backend is picked for a new
+// session.
+type OriginPoolStrategy string
+
+const (
+	// StrategyRoundRobin cycles through healthy backends in weighted order.
+	StrategyRoundRobin OriginPoolStrategy = "round-robin"
+	// StrategyLeastConnections sends new sessions to the healthy backend
+	// with the fewest active connections.
+	StrategyLeastConnections OriginPoolStrategy = "least-connections"
+	// StrategyHashUsername consistently maps a username to the same
+	// backend, so a user's repeated sessions land on one origin.
+	StrategyHashUsername OriginPoolStrategy = "hash-username"
+)
+
+// OriginPoolConfig configures health checking and backend selection for an
+// OriginPool.
+type OriginPoolConfig struct {
+	Backends      []originBackendConfig
+	Strategy      OriginPoolStrategy
+	CheckInterval time.Duration
+	CheckTimeout  time.Duration
+	ProbeUser     string
+	ProbePass     string
+}
+
+// OriginPool is a weighted set of FTP origins with background health
+// checking and automatic failover. It turns pftp from a 1:1 proxy into a
+// load balancer: newProxyServer picks a healthy backend up front, and
+// failoverOrigin is invoked automatically when the current origin fails
+// mid-session, before any transfer begins.
+type OriginPool struct {
+	mutex    sync.Mutex
+	backends []*originBackend
+	strategy OriginPoolStrategy
+	rrIndex  int
+	log      *logger
+	stopChan chan struct{}
+}
+
+// NewOriginPool builds an OriginPool and starts its background health
+// checker. Call Close to stop the checker.
+func NewOriginPool(conf OriginPoolConfig, log *logger) (*OriginPool, error) {
+	if len(conf.Backends) == 0 {
+		return nil, errors.New("origin pool requires at least one backend")
+	}
+
+	backends := make([]*originBackend, 0, len(conf.Backends))
+	for _, b := range conf.Backends {
+		weight := b.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		backends = append(backends, &originBackend{addr: b.Addr, weight: weight, healthy: true})
+	}
+
+	strategy := conf.Strategy
+	if strategy == "" {
+		strategy = StrategyRoundRobin
+	}
+
+	interval := conf.CheckInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	p := &OriginPool{
+		backends: backends,
+		strategy: strategy,
+		log:      log,
+		stopChan: make(chan struct{}),
+	}
+
+	go p.healthCheckLoop(interval, conf.CheckTimeout)
+
+	return p, nil
+}
+
+// Close stops the background health checker.
+func (p *OriginPool) Close() {
+	close(p.stopChan)
+}
+
+func (p *OriginPool) healthCheckLoop(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkAll(timeout)
+		case <-p.stopChan:
+			return
+		}
+	}
+}
+
+func (p *OriginPool) checkAll(timeout time.Duration) {
+	p.mutex.Lock()
+	backends := append([]*originBackend(nil), p.backends...)
+	p.mutex.Unlock()
+
+	for _, b := range backends {
+		healthy := probeBackend(b.addr, timeout)
+
+		p.mutex.Lock()
+		if b.healthy != healthy {
+			p.log.info("origin pool: %s is now %s", b.addr, healthStateName(healthy))
+		}
+		b.healthy = healthy
+		p.mutex.Unlock()
+	}
+}
+
+// probeBackend performs a simple TCP-connect health check against addr. It
+// is the only probe the pool runs: no FTP-level login/NOOP probe is made,
+// and OriginPoolConfig's ProbeUser and ProbePass are not used.
+func probeBackend(addr string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func healthStateName(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "unhealthy"
+}
+
+// Pick selects a healthy backend's address for a new session, according to
+// the pool's configured strategy. username is only consulted by
+// StrategyHashUsername.
+func (p *OriginPool) Pick(username string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	healthy := make([]*originBackend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.healthy {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return "", errors.New("origin pool: no healthy backends available")
+	}
+
+	switch p.strategy {
+	case StrategyLeastConnections:
+		best := healthy[0]
+		for _, b := range healthy[1:] {
+			if b.conns < best.conns {
+				best = b
+			}
+		}
+		best.conns++
+		return best.addr, nil
+	case StrategyHashUsername:
+		h := fnv.New32a()
+		h.Write([]byte(username))
+		idx := int(h.Sum32()) % len(healthy)
+		if idx < 0 {
+			idx += len(healthy)
+		}
+		return healthy[idx].addr, nil
+	default:
+		total := 0
+		for _, b := range healthy {
+			total += b.weight
+		}
+		p.rrIndex = (p.rrIndex + 1) % total
+		offset := p.rrIndex
+		for _, b := range healthy {
+			if offset < b.weight {
+				return b.addr, nil
+			}
+			offset -= b.weight
+		}
+		return healthy[0].addr, nil
+	}
+}
+
+// MarkUnhealthy immediately flags addr as unhealthy, instead of waiting for
+// the next periodic health check tick. failoverOrigin calls this on the
+// backend it's giving up on, so Pick doesn't hand the same just-failed
+// backend straight back (deterministically, in StrategyHashUsername's case)
+// before the background checker has a chance to catch up.
+func (p *OriginPool) MarkUnhealthy(addr string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, b := range p.backends {
+		if b.addr == addr {
+			if b.healthy {
+				p.log.info("origin pool: %s is now %s", addr, healthStateName(false))
+			}
+			b.healthy = false
+			break
+		}
+	}
+}
+
+// Release decrements the connection count tracked for StrategyLeastConnections
+// when a session to addr ends.
+func (p *OriginPool) Release(addr string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, b := range p.backends {
+		if b.addr == addr && b.conns > 0 {
+			b.conns--
+			break
+		}
+	}
+}
+
+// OriginBackendState is the externally visible health/weight snapshot of one
+// backend, used by the /pool REST endpoint.
+type OriginBackendState struct {
+	Addr    string `json:"addr"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	Conns   int    `json:"conns"`
+}
+
+// State returns a snapshot of every backend's current health and load, for
+// exposing over the example REST server's /pool endpoint.
+func (p *OriginPool) State() []OriginBackendState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	state := make([]OriginBackendState, 0, len(p.backends))
+	for _, b := range p.backends {
+		state = append(state, OriginBackendState{
+			Addr:    b.addr,
+			Weight:  b.weight,
+			Healthy: b.healthy,
+			Conns:   b.conns,
+		})
+	}
+	return state
+}
@@ -0,0 +1,156 @@
+package pftp
+
+import "testing"
+
+func newTestPool(strategy OriginPoolStrategy, backends ...*originBackend) *OriginPool {
+	return &OriginPool{
+		backends: backends,
+		strategy: strategy,
+	}
+}
+
+func TestPickRoundRobinCyclesWeightedBackends(t *testing.T) {
+	p := newTestPool(StrategyRoundRobin,
+		&originBackend{addr: "a", weight: 2, healthy: true},
+		&originBackend{addr: "b", weight: 1, healthy: true},
+	)
+
+	got := make([]string, 0, 6)
+	for i := 0; i < 6; i++ {
+		addr, err := p.Pick("")
+		if err != nil {
+			t.Fatalf("Pick returned error: %v", err)
+		}
+		got = append(got, addr)
+	}
+
+	counts := map[string]int{}
+	for _, addr := range got {
+		counts[addr]++
+	}
+	if counts["a"] != 4 || counts["b"] != 2 {
+		t.Fatalf("got distribution %v, want a:4 b:2 over 6 picks", counts)
+	}
+}
+
+func TestPickLeastConnectionsPrefersFewestConns(t *testing.T) {
+	p := newTestPool(StrategyLeastConnections,
+		&originBackend{addr: "a", weight: 1, healthy: true, conns: 3},
+		&originBackend{addr: "b", weight: 1, healthy: true, conns: 1},
+	)
+
+	addr, err := p.Pick("")
+	if err != nil {
+		t.Fatalf("Pick returned error: %v", err)
+	}
+	if addr != "b" {
+		t.Fatalf("Pick returned %q, want %q (fewer conns)", addr, "b")
+	}
+
+	// Picking should have incremented b's conns, so once b's count passes
+	// a's, later picks move on to a rather than always returning b.
+	if p.backends[1].conns != 2 {
+		t.Fatalf("backend %q conns = %d, want 2 after Pick", "b", p.backends[1].conns)
+	}
+}
+
+func TestPickHashUsernameIsStableForSameUser(t *testing.T) {
+	p := newTestPool(StrategyHashUsername,
+		&originBackend{addr: "a", weight: 1, healthy: true},
+		&originBackend{addr: "b", weight: 1, healthy: true},
+		&originBackend{addr: "c", weight: 1, healthy: true},
+	)
+
+	first, err := p.Pick("alice")
+	if err != nil {
+		t.Fatalf("Pick returned error: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		addr, err := p.Pick("alice")
+		if err != nil {
+			t.Fatalf("Pick returned error: %v", err)
+		}
+		if addr != first {
+			t.Fatalf("Pick(%q) = %q on call %d, want stable %q", "alice", addr, i, first)
+		}
+	}
+}
+
+func TestPickSkipsUnhealthyBackends(t *testing.T) {
+	p := newTestPool(StrategyRoundRobin,
+		&originBackend{addr: "a", weight: 1, healthy: false},
+		&originBackend{addr: "b", weight: 1, healthy: true},
+	)
+
+	for i := 0; i < 3; i++ {
+		addr, err := p.Pick("")
+		if err != nil {
+			t.Fatalf("Pick returned error: %v", err)
+		}
+		if addr != "b" {
+			t.Fatalf("Pick returned %q, want the only healthy backend %q", addr, "b")
+		}
+	}
+}
+
+func TestPickReturnsErrorWhenNoHealthyBackends(t *testing.T) {
+	p := newTestPool(StrategyRoundRobin,
+		&originBackend{addr: "a", weight: 1, healthy: false},
+		&originBackend{addr: "b", weight: 1, healthy: false},
+	)
+
+	if _, err := p.Pick(""); err == nil {
+		t.Fatal("Pick returned nil error with no healthy backends")
+	}
+}
+
+func TestReleaseDecrementsConnsWithoutGoingNegative(t *testing.T) {
+	p := newTestPool(StrategyLeastConnections,
+		&originBackend{addr: "a", weight: 1, healthy: true, conns: 1},
+	)
+
+	p.Release("a")
+	if p.backends[0].conns != 0 {
+		t.Fatalf("conns = %d, want 0 after Release", p.backends[0].conns)
+	}
+
+	p.Release("a")
+	if p.backends[0].conns != 0 {
+		t.Fatalf("conns = %d, want 0 (Release must not go negative)", p.backends[0].conns)
+	}
+}
+
+func TestMarkUnhealthyExcludesBackendFromPick(t *testing.T) {
+	p := newTestPool(StrategyHashUsername,
+		&originBackend{addr: "a", weight: 1, healthy: true},
+		&originBackend{addr: "b", weight: 1, healthy: true},
+	)
+	p.log = &logger{}
+
+	addr, err := p.Pick("alice")
+	if err != nil {
+		t.Fatalf("Pick returned error: %v", err)
+	}
+
+	p.MarkUnhealthy(addr)
+
+	for i := 0; i < 5; i++ {
+		got, err := p.Pick("alice")
+		if err != nil {
+			t.Fatalf("Pick returned error: %v", err)
+		}
+		if got == addr {
+			t.Fatalf("Pick(%q) returned %q again after it was marked unhealthy", "alice", addr)
+		}
+	}
+}
+
+func TestMarkUnhealthyIsNoopForUnknownAddr(t *testing.T) {
+	p := newTestPool(StrategyRoundRobin, &originBackend{addr: "a", weight: 1, healthy: true})
+	p.log = &logger{}
+
+	p.MarkUnhealthy("does-not-exist")
+	if !p.backends[0].healthy {
+		t.Fatal("MarkUnhealthy on an unknown address affected an existing backend")
+	}
+}
@@ -7,21 +7,28 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	proxyproto "github.com/pires/go-proxyproto"
+	"github.com/pyama86/pftp/pftp/metrics"
+	"golang.org/x/net/proxy"
 )
 
 const (
 	BUFFER_SIZE = 4096
+
+	// maxFailoverAttempts bounds how many times start() will retry a
+	// zero-bytes-transferred session against a fresh backend before giving
+	// up, so a pool where every backend fails instantly can't recurse
+	// start() without limit while waiting for the health checker to catch up.
+	maxFailoverAttempts = 3
 )
 
 type proxyServer struct {
 	id             int
 	timeout        int
+	clientConn     net.Conn
 	clientReader   *bufio.Reader
 	clientWriter   *bufio.Writer
 	originReader   *bufio.Reader
@@ -35,10 +42,31 @@ type proxyServer struct {
 	stopChan       chan struct{}
 	stop           bool
 	secureCommands []string
+	dialer         proxy.Dialer
+	modeZAllowed   bool
+	modeZ          bool
+	modeZLevel     int
+	// pendingFeat is set by sendToOrigin right after forwarding a FEAT
+	// command, so responseProxy knows the next origin reply is a multi-line
+	// FEAT body that needs MODE Z spliced in rather than a plain passthrough.
+	pendingFeat bool
+	user        string
+	pool        *OriginPool
+	originAddr  string
+	observers   []SessionObserver
+
+	// clientAddr, tlsProtocol and previousTLSCommands record how the current
+	// origin connection was set up, so failoverOrigin can reconnect to a
+	// replacement backend in the same state without the caller having to
+	// replay that context.
+	clientAddr          string
+	tlsProtocol         uint16
+	previousTLSCommands []string
 }
 
 type proxyServerConfig struct {
 	timeout        int
+	clientConn     net.Conn
 	clientReader   *bufio.Reader
 	clientWriter   *bufio.Writer
 	originAddr     string
@@ -46,15 +74,46 @@ type proxyServerConfig struct {
 	log            *logger
 	proxyProtocol  bool
 	secureCommands []string
+	upstreamProxy  string
+	modeZAllowed   bool
+	pool           *OriginPool
+	user           string
+	observers      []SessionObserver
 }
 
 func newProxyServer(conf *proxyServerConfig) (*proxyServer, error) {
-	c, err := net.Dial("tcp", conf.originAddr)
+	originAddr := conf.originAddr
+	if conf.pool != nil {
+		addr, err := conf.pool.Pick(conf.user)
+		if err != nil {
+			return nil, err
+		}
+		originAddr = addr
+	}
+
+	dialer, err := newOriginDialer(conf.upstreamProxy)
+	if err != nil {
+		if conf.pool != nil {
+			conf.pool.Release(originAddr)
+		}
+		return nil, err
+	}
+
+	c, err := dialOrigin(dialer, originAddr)
 	if err != nil {
+		if conf.pool != nil {
+			conf.pool.Release(originAddr)
+		}
 		return nil, err
 	}
 
+	clientAddr := ""
+	if conf.clientConn != nil {
+		clientAddr = conf.clientConn.RemoteAddr().String()
+	}
+
 	p := &proxyServer{
+		clientConn:     conf.clientConn,
 		clientReader:   conf.clientReader,
 		clientWriter:   conf.clientWriter,
 		originWriter:   bufio.NewWriter(c),
@@ -67,14 +126,37 @@ func newProxyServer(conf *proxyServerConfig) (*proxyServer, error) {
 		proxyProtocol:  conf.proxyProtocol,
 		stopChan:       make(chan struct{}),
 		secureCommands: conf.secureCommands,
+		dialer:         dialer,
+		modeZAllowed:   conf.modeZAllowed,
+		modeZLevel:     modeZDefaultLevel,
+		user:           conf.user,
+		pool:           conf.pool,
+		originAddr:     originAddr,
+		observers:      conf.observers,
+		clientAddr:     clientAddr,
 	}
 	p.log.debug("new proxy from=%s to=%s", c.LocalAddr(), c.RemoteAddr())
 
+	metrics.ActiveSessions.Inc()
+	notifyObservers(p.observers, func(o SessionObserver) { o.SessionStarted(p.id, p.user) })
+
 	return p, err
 }
 
 func (s *proxyServer) sendToOrigin(line string) error {
+	// MODE Z is negotiated directly between pftp and the client: the origin
+	// keeps speaking MODE S and never sees these commands.
+	if handled, reply := s.handleModeCommand(line); handled {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, err := s.clientWriter.WriteString(reply); err != nil {
+			return err
+		}
+		return s.clientWriter.Flush()
+	}
+
 	cnt := 0
+	waitStart := time.Now()
 	if s.timeout > 0 {
 		s.origin.SetReadDeadline(time.Now().Add(time.Duration(time.Second.Nanoseconds() * int64(s.timeout))))
 	}
@@ -84,22 +166,33 @@ func (s *proxyServer) sendToOrigin(line string) error {
 			return errors.New("Could not get semaphore to send to client")
 		}
 
-		s.commandLog(line)
-
 		if s.semFree() {
 			if _, err := s.origin.Write([]byte(line)); err != nil {
 				return err
 			}
+			s.commandLog(line)
+
+			command := commandVerb(line)
+			s.recordCommandMetrics(command)
+			if command == "FEAT" {
+				s.pendingFeat = true
+			}
+
 			s.semLock()
 			break
 		}
 		time.Sleep(1 * time.Second)
 		cnt++
 	}
+	metrics.SemaphoreWaitSeconds.Observe(time.Since(waitStart).Seconds())
 	return nil
 }
 
 func (s *proxyServer) responseProxy() error {
+	if s.pendingFeat {
+		s.pendingFeat = false
+		return s.handleFeatResponse()
+	}
 	return s.start(s.originReader, s.clientWriter)
 }
 
@@ -144,32 +237,11 @@ func (s *proxyServer) unsuspend() {
 
 func (s *proxyServer) Close() {
 	s.origin.Close()
-}
-
-func sendProxyHeader(conn net.Conn, clientAddr string, originAddr string) error {
-	sourceAddr := strings.Split(clientAddr, ":")
-	destinationAddr := strings.Split(originAddr, ":")
-	sourcePort, _ := strconv.Atoi(sourceAddr[1])
-	destinationPort, _ := strconv.Atoi(destinationAddr[1])
-
-	// proxyProtocolHeader's DestinationAddress must be IP! not domain name
-	hostIP, err := net.LookupIP(destinationAddr[0])
-	if err != err {
-		return err
-	}
-
-	proxyProtocolHeader := proxyproto.Header{
-		Version:            byte(1),
-		Command:            proxyproto.PROXY,
-		TransportProtocol:  proxyproto.TCPv4,
-		SourceAddress:      net.ParseIP(sourceAddr[0]),
-		DestinationAddress: net.ParseIP(hostIP[0].String()),
-		SourcePort:         uint16(sourcePort),
-		DestinationPort:    uint16(destinationPort),
+	if s.pool != nil {
+		s.pool.Release(s.originAddr)
 	}
-
-	_, err = proxyProtocolHeader.WriteTo(conn)
-	return err
+	metrics.ActiveSessions.Dec()
+	notifyObservers(s.observers, func(o SessionObserver) { o.SessionEnded(s.id, s.user) })
 }
 
 /* send command before login to origin.                  *
@@ -182,15 +254,20 @@ func (s *proxyServer) sendTLSCommand(tlsProtocol uint16, previousTLSCommands []s
 			return fmt.Errorf("failed to make TLS connection")
 		}
 
+		command := commandVerb(cmd)
+		s.recordCommandMetrics(command)
+
 		// read response from new origin server
 		str, err := reader.ReadString('\n')
 		if err != nil {
 			return fmt.Errorf("failed to make TLS connection")
 		}
 
-		if strings.Compare(strings.ToUpper(strings.SplitN(strings.Trim(cmd, "\r\n"), " ", 2)[0]), "AUTH") == 0 {
+		if strings.Compare(command, "AUTH") == 0 {
 			code := strings.SplitN(strings.Trim(str, "\r\n"), " ", 2)[0]
 			if code[0] == '5' {
+				metrics.TLSHandshakeFailures.Inc()
+				notifyObservers(s.observers, func(o SessionObserver) { o.TLSHandshakeFailed(s.id) })
 				return fmt.Errorf("origin server has not support TLS connection")
 			}
 
@@ -214,8 +291,52 @@ func (s *proxyServer) sendTLSCommand(tlsProtocol uint16, previousTLSCommands []s
 	return nil
 }
 
+// connectOrigin dials originAddr, optionally sends the PROXY protocol
+// header, reads the welcome banner and replays previousTLSCommands so the
+// new connection ends up authenticated the same way the one it replaces
+// was. On success it leaves s.origin/s.originReader/s.originWriter pointed
+// at the new connection (via sendTLSCommand) and returns the connection
+// that is now obsolete, for the caller to close once it's done relying on
+// it for error reporting.
+func (s *proxyServer) connectOrigin(clientAddr string, originAddr string, tlsProtocol uint16, previousTLSCommands []string) (net.Conn, error) {
+	c, err := dialOrigin(s.dialer, originAddr)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(c)
+	writer := bufio.NewWriter(c)
+
+	old := s.origin
+
+	// Send proxy protocol v2 header when set proxy protocol true
+	if s.proxyProtocol {
+		if err := sendProxyHeader(c, clientAddr, originAddr, s.user); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	// read welcome message
+	if _, err := reader.ReadString('\n'); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// If client connect with TLS connection, make TLS connection to origin ftp server too.
+	// If cannot make TLS connection with origin, use old to origin for quit process.
+	if err := s.sendTLSCommand(tlsProtocol, previousTLSCommands, c, reader, writer); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return old, nil
+}
+
 func (s *proxyServer) switchOrigin(clientAddr string, originAddr string, tlsProtocol uint16, previousTLSCommands []string) error {
 	s.log.info("switch origin to: %s", originAddr)
+	s.clientAddr = clientAddr
+	s.tlsProtocol = tlsProtocol
+	s.previousTLSCommands = previousTLSCommands
 
 	if s.passThrough {
 		err := s.suspend()
@@ -227,58 +348,126 @@ func (s *proxyServer) switchOrigin(clientAddr string, originAddr string, tlsProt
 
 	s.stopChan <- struct{}{}
 
-	c, err := net.Dial("tcp", originAddr)
+	old, err := s.connectOrigin(clientAddr, originAddr, tlsProtocol, previousTLSCommands)
 	if err != nil {
 		s.stop = false
 		return err
 	}
-	reader := bufio.NewReader(c)
-	writer := bufio.NewWriter(c)
+	old.Close()
 
-	old := s.origin
+	s.stop = false
+	metrics.OriginSwitches.Inc()
+	notifyObservers(s.observers, func(o SessionObserver) { o.OriginSwitched(s.id, s.originAddr, originAddr) })
+	s.originAddr = originAddr
+	return nil
+}
 
-	// Send proxy protocol v1 header when set proxy protocol true
-	if s.proxyProtocol {
-		if err := sendProxyHeader(c, clientAddr, originAddr); err != nil {
-			return err
-		}
+// failoverOrigin releases the current backend back to the pool, picks
+// another healthy one and reconnects, reusing the client address and TLS
+// setup recorded the last time the origin connection was established. It's
+// invoked directly from start()'s error path when the buffered loop's read
+// fails or the splice path's copy fails, as long as no bytes of the current
+// transfer have been relayed yet, so a dead backend never interrupts an
+// in-flight transfer. A failed write in the buffered loop ends the transfer
+// without failing over. Unlike
+// switchOrigin, it does not go through the stopChan/suspend handshake: it
+// runs after start()'s own copy loop has already stopped on the error, so
+// there is no concurrently running loop left to suspend.
+func (s *proxyServer) failoverOrigin() error {
+	if s.pool == nil {
+		return errors.New("no origin pool configured for failover")
 	}
 
-	// read welcome message
-	if _, err := reader.ReadString('\n'); err != nil {
+	s.pool.Release(s.originAddr)
+	// The backend we're failing away from just failed a live transfer; flip
+	// it unhealthy immediately rather than waiting for the next periodic
+	// health check tick, so Pick doesn't hand it straight back (which,
+	// under StrategyHashUsername, would otherwise be guaranteed).
+	s.pool.MarkUnhealthy(s.originAddr)
+
+	addr, err := s.pool.Pick(s.user)
+	if err != nil {
 		return err
 	}
 
-	// If client connect with TLS connection, make TLS connection to origin ftp server too.
-	// If cannot make TLS connection with origin, use old to origin for quit process.
-	if err := s.sendTLSCommand(tlsProtocol, previousTLSCommands, c, reader, writer); err != nil {
-		c.Close()
-
-		s.stop = false
+	old, err := s.connectOrigin(s.clientAddr, addr, s.tlsProtocol, s.previousTLSCommands)
+	if err != nil {
 		return err
 	}
-
 	old.Close()
 
-	s.stop = false
+	metrics.OriginSwitches.Inc()
+	notifyObservers(s.observers, func(o SessionObserver) { o.OriginSwitched(s.id, s.originAddr, addr) })
+	s.originAddr = addr
+	s.log.info("origin pool: failed over to %s", addr)
 	return nil
 }
 
 func (s *proxyServer) start(from *bufio.Reader, to *bufio.Writer) error {
+	return s.startWithFailoverBudget(from, to, maxFailoverAttempts)
+}
+
+// startWithFailoverBudget is start()'s actual implementation. failoverBudget
+// bounds how many more times this call chain may retry against a fresh
+// backend on a zero-bytes-transferred error, so a pool whose backends all
+// fail instantly can't recurse without limit.
+func (s *proxyServer) startWithFailoverBudget(from *bufio.Reader, to *bufio.Writer, failoverBudget int) error {
 	if s.stop {
 		return nil
 	}
 
+	direction := "in"
+	if to == s.clientWriter {
+		direction = "out"
+	}
+
+	if s.canSplice() {
+		n, err := s.runSpliceLoop(direction)
+		// runSpliceLoop sets s.stop when it was cancelled via stopChan (e.g.
+		// switchOrigin reconnecting the session deliberately), which looks
+		// identical to a real zero-bytes I/O error from here. Failing over in
+		// that case would race switchOrigin's own in-flight connectOrigin call
+		// over s.origin/s.originReader/s.originWriter with no locking, so
+		// treat a stopChan cancellation as a plain stop, same as the buffered
+		// loop below.
+		if err != nil && n == 0 && !s.stop && s.pool != nil && failoverBudget > 0 {
+			if ferr := s.failoverOrigin(); ferr == nil {
+				return s.startWithFailoverBudget(s.retryReader(from, direction), s.retryWriter(to, direction), failoverBudget-1)
+			}
+		}
+		return err
+	}
+
+	transferStart := time.Now()
+
+	// MODE Z only ever compresses the leg actually carrying the transfer,
+	// so it must stay off outside of passThrough: this same loop also
+	// relays ordinary command/response bytes while the session is waiting
+	// on a reply (see the passThrough/semLocked checks below), and those
+	// must reach the client as plaintext. Decompress what the client sends
+	// before the origin (still on MODE S) sees it, and compress what the
+	// origin sends before it reaches the client.
+	var reader io.Reader = from
+	var dataWriter modeZWriteCloser = nopWriteCloser{to}
+	if s.modeZ && s.passThrough {
+		if direction == "in" {
+			reader = s.wrapDataReader(from)
+		} else {
+			dataWriter = s.wrapDataWriter(to)
+		}
+	}
+
 	buff := make([]byte, BUFFER_SIZE)
 	read := make(chan []byte, BUFFER_SIZE)
 	done := make(chan struct{})
 	send := make(chan struct{})
 	errchan := make(chan error)
 	var lastError error
+	var transferred int64
 
 	go func() {
 		for {
-			n, err := from.Read(buff)
+			n, err := reader.Read(buff)
 			s.log.debug("response from server: %s", buff[:n])
 			if err != nil {
 				if err != io.EOF {
@@ -324,21 +513,33 @@ loop:
 			}
 
 			s.mutex.Lock()
-			_, err := to.Write(b)
+			n, err := dataWriter.Write(b)
 			if err != nil {
 				lastError = err
 				s.mutex.Unlock()
 				break loop
 			}
 
-			if err := to.Flush(); err != nil {
+			if err := dataWriter.Flush(); err != nil {
 				lastError = err
 				s.mutex.Unlock()
 				break loop
 			}
 			s.mutex.Unlock()
+
+			transferred += int64(n)
+			metrics.BytesTransferred.WithLabelValues(s.user, s.originAddr, direction).Add(float64(n))
+			notifyObservers(s.observers, func(o SessionObserver) { o.BytesTransferred(s.id, direction, int64(n)) })
+
 			send <- struct{}{}
 		case err := <-errchan:
+			if s.pool != nil && transferred == 0 && failoverBudget > 0 {
+				if ferr := s.failoverOrigin(); ferr == nil {
+					close(read)
+					<-done
+					return s.startWithFailoverBudget(s.retryReader(from, direction), s.retryWriter(to, direction), failoverBudget-1)
+				}
+			}
 			lastError = err
 			break loop
 		case <-s.stopChan:
@@ -352,12 +553,107 @@ loop:
 	close(read)
 	<-done
 
+	if err := dataWriter.Close(); err != nil && lastError == nil {
+		lastError = err
+	}
+
+	metrics.TransferDurationSeconds.WithLabelValues(direction).Observe(time.Since(transferStart).Seconds())
 	return lastError
 }
 
+// canSplice reports whether this leg of the session can bypass the
+// line-oriented buffered loop above and hand the sockets straight to
+// dataProxy. It requires passThrough mode (no pending FEAT/MODE/TLS
+// negotiation that needs the line-by-line handling) and MODE Z to be off,
+// since a deflate-wrapped stream has to be read by Go, not spliced by the
+// kernel, and a known client socket to splice against.
+func (s *proxyServer) canSplice() bool {
+	return s.passThrough && !s.modeZ && s.clientConn != nil
+}
+
+// spliceResult carries dataProxy's outcome out of runSpliceLoop's worker
+// goroutine, so both the byte count and the error are available to the
+// caller's failover decision.
+type spliceResult struct {
+	n   int64
+	err error
+}
+
+// runSpliceLoop relays one direction of the session through dataProxy
+// instead of the buffered loop, so large STOR/RETR transfers move through a
+// kernel splice instead of a mutex-guarded 4KB-at-a-time copy. It keeps the
+// same stopChan-triggered cancellation as the buffered loop above: closing
+// this leg's source socket unblocks whichever read dataProxy is currently
+// blocked on. It returns the number of bytes relayed along with any error,
+// so the caller can tell a failed transfer that never sent a byte (safe to
+// fail over) from one that died partway through.
+func (s *proxyServer) runSpliceLoop(direction string) (int64, error) {
+	dst, src := s.origin, s.clientConn
+	if direction == "out" {
+		dst, src = s.clientConn, s.origin
+	}
+
+	transferStart := time.Now()
+	done := make(chan spliceResult, 1)
+	go func() {
+		n, err := s.dataProxy(dst, src)
+		done <- spliceResult{n, err}
+	}()
+
+	var res spliceResult
+	select {
+	case res = <-done:
+	case <-s.stopChan:
+		src.Close()
+		s.stop = true
+		res = <-done
+	}
+
+	if res.n > 0 {
+		metrics.BytesTransferred.WithLabelValues(s.user, s.originAddr, direction).Add(float64(res.n))
+		notifyObservers(s.observers, func(o SessionObserver) { o.BytesTransferred(s.id, direction, res.n) })
+	}
+
+	metrics.TransferDurationSeconds.WithLabelValues(direction).Observe(time.Since(transferStart).Seconds())
+	return res.n, res.err
+}
+
+// retryReader returns the reader start() should resume with after a
+// successful failover: the client side is untouched, so only the origin
+// leg's reader needs to be swapped for the freshly reconnected one.
+func (s *proxyServer) retryReader(from *bufio.Reader, direction string) *bufio.Reader {
+	if direction == "out" {
+		return s.originReader
+	}
+	return from
+}
+
+// retryWriter is retryReader's counterpart for the writer side.
+func (s *proxyServer) retryWriter(to *bufio.Writer, direction string) *bufio.Writer {
+	if direction == "in" {
+		return s.originWriter
+	}
+	return to
+}
+
+// commandVerb extracts the upper-cased command token a client/origin command
+// line starts with, e.g. "retr file.txt\r\n" -> "RETR".
+func commandVerb(line string) string {
+	return strings.ToUpper(strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)[0])
+}
+
+// recordCommandMetrics must be called exactly once per command actually
+// written to the origin, never from a retry loop, or per-verb counters and
+// observer notifications stop reflecting real traffic.
+func (s *proxyServer) recordCommandMetrics(command string) {
+	metrics.CommandsTotal.WithLabelValues(command).Inc()
+	notifyObservers(s.observers, func(o SessionObserver) { o.CommandExecuted(s.id, command) })
+}
+
 // Hide parameters from log
 func (s *proxyServer) commandLog(line string) {
-	command := strings.ToUpper(strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)[0])
+	command := commandVerb(line)
+
 	hideParams := false
 	for _, c := range s.secureCommands {
 		if strings.Compare(command, c) == 0 {
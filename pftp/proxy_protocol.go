@@ -0,0 +1,148 @@
+package pftp
+
+import (
+	"net"
+	"strconv"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+// pp2TypeFTPUser is a custom PROXY protocol v2 TLV (the custom range is
+// 0xE0-0xEF) carrying the already-authenticated FTP username, so a
+// downstream origin can attribute the connection without re-parsing the
+// FTP session itself.
+const pp2TypeFTPUser = proxyproto.PP2Type(0xE1)
+
+// proxyProtocolPolicy is the acceptance policy applied to an inbound PROXY
+// protocol header, keyed by source subnet in config.toml.
+type proxyProtocolPolicy string
+
+const (
+	proxyProtocolRequired proxyProtocolPolicy = "required"
+	proxyProtocolOptional proxyProtocolPolicy = "optional"
+	proxyProtocolReject   proxyProtocolPolicy = "reject"
+)
+
+// proxyProtocolTransport picks the v2 header's address-family byte to match
+// source and destination, since a v2 header's SourceAddress/DestinationAddress
+// are both encoded at a single fixed 4 or 16-byte width determined by this
+// field. TCPv4 is only valid when both addresses are IPv4; either side being
+// IPv6 forces TCPv6 for the whole header.
+func proxyProtocolTransport(source net.IP, destination net.IP) proxyproto.AddressFamilyAndProtocol {
+	if source.To4() != nil && destination.To4() != nil {
+		return proxyproto.TCPv4
+	}
+	return proxyproto.TCPv6
+}
+
+// buildProxyHeader constructs the PROXY protocol v2 header (with ALPN,
+// authority and a custom username TLV) sendProxyHeader writes to the origin.
+// It's split out from sendProxyHeader so tests can inspect the resulting
+// header's fields directly, rather than only observing whether writing it
+// returned an error.
+func buildProxyHeader(clientAddr string, originAddr string, user string) (proxyproto.Header, error) {
+	sourceHost, sourcePortStr, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		return proxyproto.Header{}, err
+	}
+	destinationHost, destinationPortStr, err := net.SplitHostPort(originAddr)
+	if err != nil {
+		return proxyproto.Header{}, err
+	}
+	sourcePort, _ := strconv.Atoi(sourcePortStr)
+	destinationPort, _ := strconv.Atoi(destinationPortStr)
+
+	// proxyProtocolHeader's DestinationAddress must be IP! not domain name
+	hostIP, err := net.LookupIP(destinationHost)
+	if err != nil {
+		return proxyproto.Header{}, err
+	}
+	sourceIP := net.ParseIP(sourceHost)
+	destinationIP := hostIP[0]
+
+	header := proxyproto.Header{
+		Version:            byte(2),
+		Command:            proxyproto.PROXY,
+		TransportProtocol:  proxyProtocolTransport(sourceIP, destinationIP),
+		SourceAddress:      sourceIP,
+		DestinationAddress: destinationIP,
+		SourcePort:         uint16(sourcePort),
+		DestinationPort:    uint16(destinationPort),
+	}
+
+	tlvs := []proxyproto.TLV{
+		{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte("ftp")},
+		{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte(destinationHost)},
+	}
+	if user != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: pp2TypeFTPUser, Value: []byte(user)})
+	}
+
+	if err := header.SetTLVs(tlvs); err != nil {
+		return proxyproto.Header{}, err
+	}
+
+	return header, nil
+}
+
+// sendProxyHeader emits a PROXY protocol v2 binary header (with ALPN,
+// authority and a custom username TLV) on conn before the origin's FTP
+// banner is read, so the origin can recover the true client address.
+func sendProxyHeader(conn net.Conn, clientAddr string, originAddr string, user string) error {
+	header, err := buildProxyHeader(clientAddr, originAddr, user)
+	if err != nil {
+		return err
+	}
+
+	_, err = header.WriteTo(conn)
+	return err
+}
+
+// proxyProtocolPolicyFor resolves which acceptance policy applies to a
+// client address, falling back to "optional" when no subnet in policies
+// matches clientAddr.
+func proxyProtocolPolicyFor(clientAddr string, policies map[string]proxyProtocolPolicy) proxyProtocolPolicy {
+	host, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		host = clientAddr
+	}
+	ip := net.ParseIP(host)
+
+	for cidr, policy := range policies {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if ip != nil && subnet.Contains(ip) {
+			return policy
+		}
+	}
+
+	return proxyProtocolOptional
+}
+
+// proxyProtocolPolicyFunc adapts a per-subnet policy table into the
+// function signature expected by proxyproto.Listener, so pftp can sit
+// behind an L4 load balancer and still recover the original client IP for
+// logging, ACLs and the User middleware's routing decisions.
+func proxyProtocolPolicyFunc(policies map[string]proxyProtocolPolicy) func(upstream net.Addr) (proxyproto.Policy, error) {
+	return func(upstream net.Addr) (proxyproto.Policy, error) {
+		switch proxyProtocolPolicyFor(upstream.String(), policies) {
+		case proxyProtocolRequired:
+			return proxyproto.REQUIRE, nil
+		case proxyProtocolReject:
+			return proxyproto.REJECT, nil
+		default:
+			return proxyproto.USE, nil
+		}
+	}
+}
+
+// newProxyProtocolListener wraps l so it transparently accepts inbound
+// PROXY protocol v1/v2 headers, applying policies per source subnet.
+func newProxyProtocolListener(l net.Listener, policies map[string]proxyProtocolPolicy) net.Listener {
+	return &proxyproto.Listener{
+		Listener: l,
+		Policy:   proxyProtocolPolicyFunc(policies),
+	}
+}
@@ -0,0 +1,150 @@
+package pftp
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	proxyproto "github.com/pires/go-proxyproto"
+)
+
+func TestProxyProtocolPolicyForMatchesSubnet(t *testing.T) {
+	policies := map[string]proxyProtocolPolicy{
+		"10.0.0.0/8":     proxyProtocolRequired,
+		"192.168.0.0/16": proxyProtocolReject,
+	}
+
+	tests := []struct {
+		clientAddr string
+		want       proxyProtocolPolicy
+	}{
+		{"10.1.2.3:4321", proxyProtocolRequired},
+		{"192.168.1.1:4321", proxyProtocolReject},
+		{"203.0.113.5:4321", proxyProtocolOptional},
+	}
+
+	for _, tt := range tests {
+		if got := proxyProtocolPolicyFor(tt.clientAddr, policies); got != tt.want {
+			t.Errorf("proxyProtocolPolicyFor(%q) = %q, want %q", tt.clientAddr, got, tt.want)
+		}
+	}
+}
+
+func TestProxyProtocolPolicyForAcceptsBareIP(t *testing.T) {
+	policies := map[string]proxyProtocolPolicy{"10.0.0.0/8": proxyProtocolRequired}
+
+	if got := proxyProtocolPolicyFor("10.1.2.3", policies); got != proxyProtocolRequired {
+		t.Errorf("proxyProtocolPolicyFor with no port = %q, want %q", got, proxyProtocolRequired)
+	}
+}
+
+func TestProxyProtocolPolicyForIgnoresInvalidCIDR(t *testing.T) {
+	policies := map[string]proxyProtocolPolicy{"not-a-cidr": proxyProtocolRequired}
+
+	if got := proxyProtocolPolicyFor("10.1.2.3:4321", policies); got != proxyProtocolOptional {
+		t.Errorf("proxyProtocolPolicyFor with invalid CIDR = %q, want fallback %q", got, proxyProtocolOptional)
+	}
+}
+
+func TestProxyProtocolPolicyForDefaultsToOptional(t *testing.T) {
+	if got := proxyProtocolPolicyFor("203.0.113.5:4321", nil); got != proxyProtocolOptional {
+		t.Errorf("proxyProtocolPolicyFor with no policies = %q, want %q", got, proxyProtocolOptional)
+	}
+}
+
+func TestSendProxyHeaderAcceptsIPv6Addresses(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(io.Discard, server)
+
+	if err := sendProxyHeader(client, "[::1]:4321", "[::1]:21", "alice"); err != nil {
+		t.Fatalf("sendProxyHeader with IPv6 addresses returned error: %v", err)
+	}
+}
+
+func TestBuildProxyHeaderSelectsTransportByAddressFamily(t *testing.T) {
+	tests := []struct {
+		name          string
+		clientAddr    string
+		originAddr    string
+		wantTransport proxyproto.AddressFamilyAndProtocol
+		wantSourceIP  net.IP
+		wantDestIP    net.IP
+	}{
+		{
+			name:          "ipv4",
+			clientAddr:    "203.0.113.5:4321",
+			originAddr:    "127.0.0.1:21",
+			wantTransport: proxyproto.TCPv4,
+			wantSourceIP:  net.ParseIP("203.0.113.5"),
+			wantDestIP:    net.ParseIP("127.0.0.1"),
+		},
+		{
+			name:          "ipv6",
+			clientAddr:    "[::1]:4321",
+			originAddr:    "[::1]:21",
+			wantTransport: proxyproto.TCPv6,
+			wantSourceIP:  net.ParseIP("::1"),
+			wantDestIP:    net.ParseIP("::1"),
+		},
+		{
+			name:          "mixed families force TCPv6",
+			clientAddr:    "203.0.113.5:4321",
+			originAddr:    "[::1]:21",
+			wantTransport: proxyproto.TCPv6,
+			wantSourceIP:  net.ParseIP("203.0.113.5"),
+			wantDestIP:    net.ParseIP("::1"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, err := buildProxyHeader(tt.clientAddr, tt.originAddr, "alice")
+			if err != nil {
+				t.Fatalf("buildProxyHeader returned error: %v", err)
+			}
+			if header.TransportProtocol != tt.wantTransport {
+				t.Errorf("TransportProtocol = %v, want %v", header.TransportProtocol, tt.wantTransport)
+			}
+			if !header.SourceAddress.Equal(tt.wantSourceIP) {
+				t.Errorf("SourceAddress = %v, want %v", header.SourceAddress, tt.wantSourceIP)
+			}
+			if !header.DestinationAddress.Equal(tt.wantDestIP) {
+				t.Errorf("DestinationAddress = %v, want %v", header.DestinationAddress, tt.wantDestIP)
+			}
+		})
+	}
+}
+
+type stubAddr string
+
+func (a stubAddr) Network() string { return "tcp" }
+func (a stubAddr) String() string  { return string(a) }
+
+func TestProxyProtocolPolicyFuncMapsPolicyToDecision(t *testing.T) {
+	policies := map[string]proxyProtocolPolicy{
+		"10.0.0.0/8":     proxyProtocolRequired,
+		"192.168.0.0/16": proxyProtocolReject,
+	}
+	fn := proxyProtocolPolicyFunc(policies)
+
+	tests := []struct {
+		addr string
+		want proxyproto.Policy
+	}{
+		{"10.1.2.3:4321", proxyproto.REQUIRE},
+		{"192.168.1.1:4321", proxyproto.REJECT},
+		{"203.0.113.5:4321", proxyproto.USE},
+	}
+
+	for _, tt := range tests {
+		got, err := fn(stubAddr(tt.addr))
+		if err != nil {
+			t.Fatalf("proxyProtocolPolicyFunc(%q) returned error: %v", tt.addr, err)
+		}
+		if got != tt.want {
+			t.Errorf("proxyProtocolPolicyFunc(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
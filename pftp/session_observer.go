@@ -0,0 +1,32 @@
+package pftp
+
+// SessionObserver lets users register their own sinks (statsd,
+// OpenTelemetry, ...) for session lifecycle and transfer events, alongside
+// the built-in Prometheus metrics in pftp/metrics. All methods are called
+// synchronously from the session's goroutine, so implementations must not
+// block.
+type SessionObserver interface {
+	// SessionStarted is called once a session's origin connection is
+	// established.
+	SessionStarted(id int, user string)
+	// SessionEnded is called once a session's origin connection closes.
+	SessionEnded(id int, user string)
+	// BytesTransferred is called after each chunk copied between client and
+	// origin, direction is "in" or "out".
+	BytesTransferred(id int, direction string, n int64)
+	// CommandExecuted is called for every command forwarded to the origin.
+	CommandExecuted(id int, command string)
+	// OriginSwitched is called after a session's origin connection changes,
+	// whether triggered by the webapi or by pool failover.
+	OriginSwitched(id int, from string, to string)
+	// TLSHandshakeFailed is called when a session fails to negotiate TLS
+	// with its origin.
+	TLSHandshakeFailed(id int)
+}
+
+// notifyObservers fans a callback out to every registered SessionObserver.
+func notifyObservers(observers []SessionObserver, fn func(SessionObserver)) {
+	for _, o := range observers {
+		fn(o)
+	}
+}